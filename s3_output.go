@@ -3,15 +3,24 @@ package s3
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/prometheus/client_golang/prometheus"
 	"io"
+	"math/rand"
+	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,15 +30,26 @@ const MINUTE_TO_TICK int = 00
 const SECOND_TO_TICK int = 00
 
 type S3OutputConfig struct {
-	SecretKey        string `toml:"secret_key"`
-	AccessKey        string `toml:"access_key"`
-	Region           string `toml:"region"`
-	Bucket           string `toml:"bucket"`
-	Prefix           string `toml:"prefix"`
-	TickerInterval   uint   `toml:"ticker_interval"`
-	Compression      bool   `toml:"compression"`
-	BufferPath       string `toml:"buffer_path"`
-	BufferChunkLimit int    `toml:"buffer_chunk_limit"`
+	SecretKey            string `toml:"secret_key"`
+	AccessKey            string `toml:"access_key"`
+	Region               string `toml:"region"`
+	Bucket               string `toml:"bucket"`
+	Prefix               string `toml:"prefix"`
+	TickerInterval       uint   `toml:"ticker_interval"`
+	Compression          bool   `toml:"compression"`
+	BufferPath           string `toml:"buffer_path"`
+	BufferChunkLimit     int    `toml:"buffer_chunk_limit"`
+	MultipartThreshold   int64  `toml:"multipart_threshold"`
+	SSE                  bool   `toml:"sse"`
+	SSECustomerAlgorithm string `toml:"sse_customer_algorithm"`
+	SSECustomerKey       string `toml:"sse_customer_key"`
+	SSECustomerKeyMD5    string `toml:"sse_customer_key_md5"`
+	StorageClass         string `toml:"storage_class"`
+	ACL                  string `toml:"acl"`
+	Endpoint             string `toml:"endpoint"`
+	CompressionLevel     int    `toml:"compression_level"`
+	CompressionAlgorithm string `toml:"compression_algorithm"`
+	MaxRetries           int    `toml:"max_retries"`
 }
 
 type S3Output struct {
@@ -37,6 +57,50 @@ type S3Output struct {
 	client         *s3.S3
 	bucket         *s3.Bucket
 	bufferFilePath string
+
+	segmentFile     *os.File
+	openSegmentPath string
+	segmentSize     int
+	segmentSeq      int
+	pendingSegments []string
+	bufferedBytes   int64
+
+	// authMu guards client.Auth: watchCredentialExpiry writes a refreshed
+	// Auth from its own goroutine while Run's goroutine concurrently signs
+	// requests with it via so.bucket's methods.
+	authMu sync.RWMutex
+}
+
+// openSegmentSuffix marks a segment that's still being appended to. On a
+// clean rotation (or at recovery time) it's dropped via an atomic rename,
+// which is what makes a sealed segment safe to enqueue for upload.
+const openSegmentSuffix = ".open"
+
+// compressingSuffix marks the temporary output of an in-progress
+// compressSegmentFile call. It's only ever a partial write, so recovery
+// discards it rather than enqueuing it.
+const compressingSuffix = ".compressing"
+
+// knownCompressionExts lists every extension compressSegmentFile can append.
+// Recovery uses it to tell an already-compressed segment apart from a plain
+// one so it isn't compressed a second time.
+var knownCompressionExts = []string{".gz", ".snappy", ".zst"}
+
+// stripKnownCompressionExt trims a trailing compression extension, if any,
+// so callers can recover the original ".NNNNN" sequence suffix underneath.
+func stripKnownCompressionExt(path string) string {
+	for _, ext := range knownCompressionExts {
+		if strings.HasSuffix(path, ext) {
+			return strings.TrimSuffix(path, ext)
+		}
+	}
+	return path
+}
+
+// isCompressedSegment reports whether segmentPath already carries one of
+// knownCompressionExts, i.e. compressSegmentFile has already run on it.
+func isCompressedSegment(segmentPath string) bool {
+	return stripKnownCompressionExt(segmentPath) != segmentPath
 }
 
 func midnightTickerUpdate() *time.Ticker {
@@ -48,36 +112,277 @@ func midnightTickerUpdate() *time.Ticker {
 	return time.NewTicker(diff)
 }
 
+const minMultipartThreshold int64 = 5 * 1024 * 1024
+
+// multipartPartSize is the size of each part streamed by uploadMultipart. It
+// is fixed independently of MultipartThreshold (which only decides whether a
+// segment goes multipart at all) so that raising the threshold to make
+// multipart kick in less often can't balloon the part buffer held in memory.
+// It matches S3's minimum part size, same as minMultipartThreshold.
+const multipartPartSize = minMultipartThreshold
+
+// defaultBufferChunkLimit is the out-of-the-box segment size cap. It's kept
+// comfortably above minMultipartThreshold so that, with default
+// MultipartThreshold, a segment can actually grow large enough to take the
+// multipart path instead of always fitting under the single-Put threshold.
+const defaultBufferChunkLimit = 8 * 1024 * 1024
+
+var validACLs = map[string]bool{
+	"private":                   true,
+	"public-read":               true,
+	"authenticated-read":        true,
+	"bucket-owner-full-control": true,
+}
+
+var validStorageClasses = map[string]bool{
+	"STANDARD":           true,
+	"STANDARD_IA":        true,
+	"REDUCED_REDUNDANCY": true,
+	"GLACIER":            true,
+}
+
+var validCompressionAlgorithms = map[string]bool{
+	"gzip":   true,
+	"snappy": true,
+	"zstd":   true,
+	"none":   true,
+}
+
+const defaultCompressionLevel = 6
+
+// credentialRefreshSkew is how long before an instance-role credential's
+// Expiration we proactively fetch a replacement, so in-flight uploads never
+// race a freshly-expired Auth.
+const credentialRefreshSkew = 5 * time.Minute
+const credentialRefreshRetryInterval = 30 * time.Second
+
+const defaultMaxRetries = 5
+const retryBaseBackoff = 500 * time.Millisecond
+const retryMaxBackoff = 30 * time.Second
+
+var (
+	uploadBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "heka_s3_upload_bytes_total",
+		Help: "Total number of bytes uploaded to S3.",
+	})
+	uploadDurationSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "heka_s3_upload_duration_seconds",
+		Help:    "Duration of individual S3 upload operations (Put/InitMulti/PutPart/Complete), in seconds.",
+		Buckets: prometheus.DefBuckets,
+	})
+	uploadErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "heka_s3_upload_errors_total",
+		Help: "Total number of S3 upload errors, labeled by error code.",
+	}, []string{"code"})
+	bufferBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "heka_s3_buffer_bytes",
+		Help: "Current size, in bytes, of buffered data not yet uploaded to S3.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(uploadBytesTotal, uploadDurationSeconds, uploadErrorsTotal, bufferBytesGauge)
+}
+
 func (so *S3Output) ConfigStruct() interface{} {
-	return &S3OutputConfig{Compression: true, BufferChunkLimit: 1000000}
+	return &S3OutputConfig{
+		Compression:        true,
+		BufferChunkLimit:   defaultBufferChunkLimit,
+		MultipartThreshold: minMultipartThreshold,
+		StorageClass:       "STANDARD",
+		ACL:                "private",
+		CompressionLevel:   defaultCompressionLevel,
+		MaxRetries:         defaultMaxRetries,
+	}
 }
 
 func (so *S3Output) Init(config interface{}) (err error) {
 	so.config = config.(*S3OutputConfig)
-	auth, err := aws.GetAuth(so.config.AccessKey, so.config.SecretKey, "", time.Now())
+
+	// An empty AccessKey falls through to aws.GetAuth's env var / shared
+	// ~/.aws/credentials (honoring AWS_PROFILE) / EC2-ECS instance-role
+	// lookup, in that order, rather than requiring static keys in the TOML.
+	auth, err := aws.GetAuth(so.config.AccessKey, so.config.SecretKey, "", time.Time{})
 	if err != nil {
 		return
 	}
-	region, ok := aws.Regions[so.config.Region]
-	if !ok {
-		err = errors.New("Region of that name not found.")
-		return
+	var region aws.Region
+	if so.config.Endpoint != "" {
+		region = aws.Region{Name: "custom", S3Endpoint: so.config.Endpoint}
+	} else {
+		var ok bool
+		region, ok = aws.Regions[so.config.Region]
+		if !ok {
+			err = errors.New("Region of that name not found.")
+			return
+		}
 	}
 	so.client = s3.New(auth, region)
 	so.bucket = so.client.Bucket(so.config.Bucket)
 
+	if so.config.AccessKey == "" {
+		so.watchCredentialExpiry(auth)
+	}
+
+	if so.config.MultipartThreshold < minMultipartThreshold {
+		so.config.MultipartThreshold = minMultipartThreshold
+	}
+
+	if !validACLs[so.config.ACL] {
+		err = errors.New("ACL of that name not found.")
+		return
+	}
+	if !validStorageClasses[so.config.StorageClass] {
+		err = errors.New("StorageClass of that name not found.")
+		return
+	}
+
+	if so.config.CompressionAlgorithm == "" {
+		// Preserve pre-existing "compression" configs: true meant gzip,
+		// false meant no compression.
+		if so.config.Compression {
+			so.config.CompressionAlgorithm = "gzip"
+		} else {
+			so.config.CompressionAlgorithm = "none"
+		}
+	}
+	if !validCompressionAlgorithms[so.config.CompressionAlgorithm] {
+		err = errors.New("CompressionAlgorithm of that name not found.")
+		return
+	}
+	if so.config.CompressionAlgorithm == "gzip" && (so.config.CompressionLevel < 1 || so.config.CompressionLevel > 9) {
+		err = errors.New("CompressionLevel must be between 1 and 9.")
+		return
+	}
+	if so.config.MaxRetries < 0 {
+		err = errors.New("MaxRetries must not be negative.")
+		return
+	}
+
 	prefixList := strings.Split(so.config.Prefix, "/")
 	bufferFileName := so.config.Bucket + strings.Join(prefixList, "_")
 	so.bufferFilePath = so.config.BufferPath + "/" + bufferFileName
+
+	if err = os.MkdirAll(so.config.BufferPath, 0755); err != nil {
+		return
+	}
+	err = so.recoverSegments()
 	return
 }
 
+// recoverSegments enumerates segments left over from a prior run (a crash
+// between WriteToBuffer calls and the next ticker, say) and enqueues them for
+// upload once Run starts. A segment still carrying the openSegmentSuffix was
+// mid-write when the process died; since every append is f.Sync()'d, it's
+// sealed in place rather than discarded.
+//
+// compressSegmentFile can also have been interrupted mid-flight, so this
+// also: discards any leftover compressingSuffix fragment (the source segment
+// it was compressing is untouched and gets recovered on its own), and, if
+// both the pre-compression segment and its already-compressed replacement
+// survived the crash, keeps only the compressed one and drops the stale
+// original.
+func (so *S3Output) recoverSegments() (err error) {
+	matches, err := filepath.Glob(so.bufferFilePath + ".[0-9][0-9][0-9][0-9][0-9]*")
+	if err != nil {
+		return
+	}
+	sort.Strings(matches)
+
+	bySeq := make(map[int]string)
+	var seqOrder []int
+
+	for _, segmentPath := range matches {
+		if strings.HasSuffix(segmentPath, openSegmentSuffix) {
+			sealedPath := strings.TrimSuffix(segmentPath, openSegmentSuffix)
+			if err = os.Rename(segmentPath, sealedPath); err != nil {
+				return
+			}
+			segmentPath = sealedPath
+		}
+
+		if strings.HasSuffix(segmentPath, compressingSuffix) {
+			os.Remove(segmentPath)
+			continue
+		}
+
+		seq, serr := strconv.Atoi(strings.TrimPrefix(filepath.Ext(stripKnownCompressionExt(segmentPath)), "."))
+		if serr != nil {
+			continue
+		}
+
+		if prev, ok := bySeq[seq]; ok {
+			// Sorted order puts the shorter, pre-compression name first, so
+			// the entry we're replacing it with is the compressed one.
+			os.Remove(prev)
+		} else {
+			seqOrder = append(seqOrder, seq)
+		}
+		bySeq[seq] = segmentPath
+
+		if seq > so.segmentSeq {
+			so.segmentSeq = seq
+		}
+	}
+
+	sort.Ints(seqOrder)
+	for _, seq := range seqOrder {
+		segmentPath := bySeq[seq]
+		so.pendingSegments = append(so.pendingSegments, segmentPath)
+
+		if fi, serr := os.Stat(segmentPath); serr == nil {
+			so.bufferedBytes += fi.Size()
+		}
+	}
+	bufferBytesGauge.Set(float64(so.bufferedBytes))
+
+	return
+}
+
+// watchCredentialExpiry refreshes instance-role credentials in the
+// background before they expire, keeping so.client.Auth current without
+// requiring a restart. It's a no-op for static or non-expiring credentials.
+func (so *S3Output) watchCredentialExpiry(auth aws.Auth) {
+	if auth.Expiration().IsZero() {
+		return
+	}
+
+	go func() {
+		current := auth
+		for {
+			wait := current.Expiration().Sub(time.Now()) - credentialRefreshSkew
+			if wait < 0 {
+				wait = 0
+			}
+			time.Sleep(wait)
+
+			newAuth, err := aws.GetAuth("", "", "", time.Time{})
+			if err != nil {
+				time.Sleep(credentialRefreshRetryInterval)
+				continue
+			}
+
+			so.authMu.Lock()
+			so.client.Auth = newAuth
+			so.authMu.Unlock()
+			current = newAuth
+			if current.Expiration().IsZero() {
+				return
+			}
+		}
+	}()
+}
+
 func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
 	inChan := or.InChan()
 	tickerChan := or.Ticker()
-	buffer := bytes.NewBuffer(nil)
 	midnightTicker := midnightTickerUpdate()
 
+	if len(so.pendingSegments) > 0 {
+		or.LogMessage(fmt.Sprintf("Recovering %d buffered segment(s) from a prior run.", len(so.pendingSegments)))
+		so.uploadPendingSegments(or, false)
+	}
+
 	var (
 		pack     *PipelinePack
 		outBytes []byte
@@ -96,7 +401,7 @@ func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
 			if outBytes, err = or.Encode(pack); err != nil {
 				or.LogError(fmt.Errorf("Error encoding message: %s", err))
 			} else if outBytes != nil {
-				err = so.WriteToBuffer(buffer, outBytes, or)
+				err = so.WriteToBuffer(outBytes, or)
 			}
 			if err != nil {
 				or.LogMessage(fmt.Sprintf("Warning, unable to write to buffer: %s", err))
@@ -106,25 +411,19 @@ func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
 			pack.Recycle(nil)
 		case <-tickerChan:
 			or.LogMessage(fmt.Sprintf("Ticker fired, uploading payload."))
-			err := so.Upload(buffer, or, false)
-			if err != nil {
+			if err := so.flushAndUpload(or, false); err != nil {
 				or.LogMessage(fmt.Sprintf("Warning, unable to upload payload: %s", err))
-				err = nil
-				continue
+			} else {
+				or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
 			}
-			or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
-			buffer.Reset()
 		case <-midnightTicker.C:
 			midnightTicker = midnightTickerUpdate()
 			or.LogMessage(fmt.Sprintf("Midnight ticker fired, uploading payload."))
-			err := so.Upload(buffer, or, true)
-			if err != nil {
+			if err := so.flushAndUpload(or, true); err != nil {
 				or.LogMessage(fmt.Sprintf("Warning, unable to upload payload: %s", err))
-				err = nil
-				continue
+			} else {
+				or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
 			}
-			or.LogMessage(fmt.Sprintf("Payload uploaded successfully."))
-			buffer.Reset()
 		}
 	}
 
@@ -132,75 +431,207 @@ func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
 	return
 }
 
-func (so *S3Output) WriteToBuffer(buffer *bytes.Buffer, outBytes []byte, or OutputRunner) (err error) {
-	_, err = buffer.Write(outBytes)
-	if err != nil {
+func (so *S3Output) WriteToBuffer(outBytes []byte, or OutputRunner) (err error) {
+	if so.segmentFile == nil {
+		if err = so.openNewSegment(); err != nil {
+			return
+		}
+	}
+
+	if _, err = so.segmentFile.Write(outBytes); err != nil {
 		return
 	}
-	if buffer.Len() > so.config.BufferChunkLimit {
-		err = so.SaveToDisk(buffer, or)
+	if err = so.segmentFile.Sync(); err != nil {
+		return
+	}
+	so.segmentSize += len(outBytes)
+	so.bufferedBytes += int64(len(outBytes))
+	bufferBytesGauge.Set(float64(so.bufferedBytes))
+
+	if so.segmentSize >= so.config.BufferChunkLimit {
+		err = so.rotateSegment(or)
 	}
 	return
 }
 
-func (so *S3Output) SaveToDisk(buffer *bytes.Buffer, or OutputRunner) (err error) {
-	_, err = os.Stat(so.config.BufferPath)
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(so.config.BufferPath, 0666)
-		if err != nil {
-			return
-		}
-	}
+func (so *S3Output) segmentPath(seq int) string {
+	return fmt.Sprintf("%s.%05d", so.bufferFilePath, seq)
+}
+
+func (so *S3Output) openNewSegment() (err error) {
+	so.segmentSeq++
+	path := so.segmentPath(so.segmentSeq) + openSegmentSuffix
 
-	err = os.Chdir(so.config.BufferPath)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		return
 	}
+	so.segmentFile = f
+	so.openSegmentPath = path
+	so.segmentSize = 0
+	return
+}
 
-	_, err = os.Stat(so.bufferFilePath)
-	if os.IsNotExist(err) {
-		or.LogMessage("Creating buffer file: " + so.bufferFilePath)
-		w, err := os.Create(so.bufferFilePath)
-		w.Close()
-		if err != nil {
-			return err
-		}
+// rotateSegment seals the currently-open segment with an atomic rename,
+// queuing it for upload, and clears the in-memory segment state so the next
+// WriteToBuffer call opens a fresh one.
+func (so *S3Output) rotateSegment(or OutputRunner) (err error) {
+	if so.segmentFile == nil || so.segmentSize == 0 {
+		return
 	}
 
-	f, err := os.OpenFile(so.bufferFilePath, os.O_APPEND|os.O_WRONLY, 0666)
-	if err != nil {
+	if err = so.segmentFile.Close(); err != nil {
 		return
 	}
-	defer f.Close()
 
-	_, err = f.Write(buffer.Bytes())
-	if err != nil {
+	sealedPath := strings.TrimSuffix(so.openSegmentPath, openSegmentSuffix)
+	if err = os.Rename(so.openSegmentPath, sealedPath); err != nil {
 		return
 	}
 
-	buffer.Reset()
+	so.pendingSegments = append(so.pendingSegments, sealedPath)
+	so.segmentFile = nil
+	so.openSegmentPath = ""
+	so.segmentSize = 0
+	return
+}
 
+// flushAndUpload rotates the in-progress segment (if any) so it's included,
+// then uploads every queued segment, returning the first upload error.
+func (so *S3Output) flushAndUpload(or OutputRunner, isMidnight bool) (err error) {
+	if err = so.rotateSegment(or); err != nil {
+		return
+	}
+	if len(so.pendingSegments) == 0 {
+		err = errors.New("Nothing to upload.")
+		return
+	}
+	err = so.uploadPendingSegments(or, isMidnight)
 	return
 }
 
-func (so *S3Output) ReadFromDisk(or OutputRunner) (buffer *bytes.Buffer, err error) {
-	if so.config.Compression {
-		or.LogMessage("Compressing buffer file...")
-		cmd := exec.Command("gzip", so.bufferFilePath)
-		err = cmd.Run()
-		if err != nil {
-			return nil, err
-		}
-		// rename to original filename without .gz extension
-		cmd = exec.Command("mv", so.bufferFilePath+".gz", so.bufferFilePath)
-		err = cmd.Run()
+// uploadPendingSegments uploads each queued segment in order. A segment that
+// fails to upload, along with anything queued after it, is left in
+// so.pendingSegments so it's retried on the next tick, and the error is
+// returned.
+func (so *S3Output) uploadPendingSegments(or OutputRunner, isMidnight bool) error {
+	segments := so.pendingSegments
+	so.pendingSegments = nil
+
+	for i, segment := range segments {
+		leftPath, err := so.uploadSegment(segment, or, isMidnight)
 		if err != nil {
-			return nil, err
+			or.LogMessage(fmt.Sprintf("Warning, unable to upload segment %s: %s", segment, err))
+			// Queue the file as it now sits on disk, which is the compressed
+			// copy if compression already replaced segment.
+			segments[i] = leftPath
+			so.pendingSegments = append(so.pendingSegments, segments[i:]...)
+			return err
 		}
 	}
+	return nil
+}
+
+// compressSegmentFile streams a sealed segment file through the configured
+// codec in-process and returns the path of the result, which carries a
+// compression extension (".gz", ".snappy", ".zst") instead of replacing
+// segmentPath in place. That extension is what lets recoverSegments tell an
+// already-compressed segment apart from a plain one after a crash, so a
+// segment is never compressed twice or uploaded as a truncated fragment.
+//
+// It writes to a compressingSuffix temp file first and only renames it into
+// place, then removes segmentPath, once the codec has fully flushed -- a
+// crash mid-compression leaves segmentPath untouched and the temp file gets
+// discarded on recovery. This avoids shelling out to gzip/mv, so the plugin
+// has no dependency on what's on PATH and works on Windows and scratch
+// containers.
+func (so *S3Output) compressSegmentFile(segmentPath string, or OutputRunner) (string, error) {
+	if so.config.CompressionAlgorithm == "none" || isCompressedSegment(segmentPath) {
+		return segmentPath, nil
+	}
+
+	or.LogMessage("Compressing buffer file...")
+
+	src, err := os.Open(segmentPath)
+	if err != nil {
+		return segmentPath, err
+	}
+	defer src.Close()
+
+	finalPath := segmentPath + so.compressionExt()
+	tmpPath := finalPath + compressingSuffix
+	dst, err := os.Create(tmpPath)
+	if err != nil {
+		return segmentPath, err
+	}
+
+	var w io.WriteCloser
+	switch so.config.CompressionAlgorithm {
+	case "gzip":
+		w, err = gzip.NewWriterLevel(dst, so.config.CompressionLevel)
+	case "snappy":
+		w = snappy.NewBufferedWriter(dst)
+	case "zstd":
+		w, err = zstd.NewWriter(dst)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return segmentPath, err
+	}
+
+	_, err = io.Copy(w, src)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return segmentPath, err
+	}
+
+	if err = os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return segmentPath, err
+	}
+	if err = os.Remove(segmentPath); err != nil {
+		return finalPath, err
+	}
+
+	return finalPath, nil
+}
+
+func (so *S3Output) compressionExt() string {
+	switch so.config.CompressionAlgorithm {
+	case "gzip":
+		return ".gz"
+	case "snappy":
+		return ".snappy"
+	case "zstd":
+		return ".zst"
+	default:
+		return ""
+	}
+}
 
+func (so *S3Output) compressionContentType() string {
+	switch so.config.CompressionAlgorithm {
+	case "gzip":
+		return "multipart/x-gzip"
+	case "snappy":
+		return "application/x-snappy-framed"
+	case "zstd":
+		return "application/zstd"
+	default:
+		return "text/plain"
+	}
+}
+
+func (so *S3Output) ReadFromDisk(segmentPath string, or OutputRunner) (buffer *bytes.Buffer, err error) {
 	or.LogMessage("Uploading, reading from buffer file.")
-	fi, err := os.Open(so.bufferFilePath)
+	fi, err := os.Open(segmentPath)
 	if err != nil {
 		return
 	}
@@ -227,19 +658,108 @@ func (so *S3Output) ReadFromDisk(or OutputRunner) (buffer *bytes.Buffer, err err
 	return buffer, err
 }
 
-func (so *S3Output) Upload(buffer *bytes.Buffer, or OutputRunner, isMidnight bool) (err error) {
-	_, err = os.Stat(so.bufferFilePath)
-	if buffer.Len() == 0 && os.IsNotExist(err) {
-		err = errors.New("Nothing to upload.")
-		return
+// isRetryableError reports whether an error is transient (request timeouts,
+// throttling, 5xx, or a flaky underlying connection) as opposed to permanent
+// (403, NoSuchBucket, and the like), which should fail fast instead of
+// burning through retries.
+func isRetryableError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		switch s3err.Code {
+		case "RequestTimeout", "SlowDown":
+			return true
+		}
+		return s3err.StatusCode >= 500
+	}
+
+	// Connection resets, dial timeouts, DNS hiccups, and deadline-exceeded
+	// errors never reach goamz's *s3.Error wrapping, but they're exactly
+	// the flaky-network failures retries exist to survive.
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func errorCode(err error) string {
+	if s3err, ok := err.(*s3.Error); ok {
+		if s3err.Code != "" {
+			return s3err.Code
+		}
+		return strconv.Itoa(s3err.StatusCode)
+	}
+	return "unknown"
+}
+
+// retryBackoff returns an exponential backoff duration for the given attempt
+// number (0-indexed), capped at retryMaxBackoff and jittered by up to half
+// its value so a batch of failing outputs doesn't retry in lockstep.
+func retryBackoff(attempt int) time.Duration {
+	d := retryBaseBackoff * time.Duration(1<<uint(attempt))
+	if d > retryMaxBackoff || d <= 0 {
+		d = retryMaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2+1)))
+}
+
+// withRetry runs op with exponential-backoff retries, recording upload
+// duration and error metrics along the way. Permanent errors, and errors on
+// the final attempt, are returned immediately.
+func (so *S3Output) withRetry(or OutputRunner, opName string, op func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err = op()
+		uploadDurationSeconds.Observe(time.Since(start).Seconds())
+
+		if err == nil {
+			return nil
+		}
+
+		uploadErrorsTotal.WithLabelValues(errorCode(err)).Inc()
+
+		if !isRetryableError(err) || attempt >= so.config.MaxRetries {
+			return err
+		}
+
+		wait := retryBackoff(attempt)
+		or.LogMessage(fmt.Sprintf("Retryable error during %s (attempt %d/%d): %s; retrying in %s.",
+			opName, attempt+1, so.config.MaxRetries, err, wait))
+		time.Sleep(wait)
+	}
+}
+
+// withAuthRLock runs fn while holding authMu for reading, so it can't
+// observe a torn write from watchCredentialExpiry mid-request.
+func (so *S3Output) withAuthRLock(fn func() error) error {
+	so.authMu.RLock()
+	defer so.authMu.RUnlock()
+	return fn()
+}
+
+func (so *S3Output) putOptions() s3.Options {
+	return s3.Options{
+		SSE:                  so.config.SSE,
+		SSECustomerAlgorithm: so.config.SSECustomerAlgorithm,
+		SSECustomerKey:       so.config.SSECustomerKey,
+		SSECustomerKeyMD5:    so.config.SSECustomerKeyMD5,
+		StorageClass:         s3.StorageClass(so.config.StorageClass),
 	}
+}
 
-	err = so.SaveToDisk(buffer, or)
+// uploadSegment compresses, then uploads, a single sealed segment file,
+// removing it from disk once S3 confirms receipt. It returns the path the
+// segment's data is stored at on disk, which differs from segmentPath once
+// compression has run.
+func (so *S3Output) uploadSegment(segmentPath string, or OutputRunner, isMidnight bool) (compressedPath string, err error) {
+	compressedPath = segmentPath
+	origInfo, err := os.Stat(segmentPath)
 	if err != nil {
 		return
 	}
+	origSize := origInfo.Size()
 
-	buffer, err = so.ReadFromDisk(or)
+	// compressedPath carries a compression extension of its own and may
+	// differ from segmentPath; everything below operates on it so a segment
+	// recovered already-compressed (compressSegmentFile was a no-op for it)
+	// is handled the same way as one compressed just now.
+	compressedPath, err = so.compressSegmentFile(segmentPath, or)
 	if err != nil {
 		return
 	}
@@ -247,8 +767,7 @@ func (so *S3Output) Upload(buffer *bytes.Buffer, or OutputRunner, isMidnight boo
 	var (
 		currentTime = time.Now().Local().Format("20060102150405")
 		currentDate = ""
-		ext         = ""
-		contentType = "text/plain"
+		contentType = so.compressionContentType()
 	)
 
 	if isMidnight {
@@ -257,17 +776,120 @@ func (so *S3Output) Upload(buffer *bytes.Buffer, or OutputRunner, isMidnight boo
 		currentDate = time.Now().Local().Format("2006-01-02 15:00:00 +0800")[0:10]
 	}
 
-	if so.config.Compression {
-		ext = ".gz"
-		contentType = "multipart/x-gzip"
+	// Segments sealed within the same wall-clock second would otherwise
+	// collide on an identical key; the segment's own sequence number (the
+	// ".NNNNN" suffix its filename ends in) keeps every upload unique.
+	segmentSeqStr := strings.TrimPrefix(filepath.Ext(stripKnownCompressionExt(compressedPath)), ".")
+	ext := strings.TrimPrefix(compressedPath, stripKnownCompressionExt(compressedPath))
+	path := so.config.Prefix + "/" + currentDate + "/" + currentTime + "-" + segmentSeqStr + ext
+
+	fi, err := os.Stat(compressedPath)
+	if err != nil {
+		return
 	}
 
-	path := so.config.Prefix + "/" + currentDate + "/" + currentTime + ext
-	err = so.bucket.Put(path, buffer.Bytes(), contentType, "public-read", s3.Options{})
+	if fi.Size() > so.config.MultipartThreshold {
+		err = so.uploadMultipart(compressedPath, path, contentType, fi.Size(), or)
+	} else {
+		var buffer *bytes.Buffer
+		buffer, err = so.ReadFromDisk(compressedPath, or)
+		if err != nil {
+			return
+		}
+		err = so.withRetry(or, "Put", func() error {
+			return so.withAuthRLock(func() error {
+				return so.bucket.Put(path, buffer.Bytes(), contentType, s3.ACL(so.config.ACL), so.putOptions())
+			})
+		})
+		if err == nil {
+			uploadBytesTotal.Add(float64(buffer.Len()))
+		}
+	}
 
 	or.LogMessage("Upload finished, removing buffer file on disk.")
 	if err == nil {
-		err = os.Remove(so.bufferFilePath)
+		err = os.Remove(compressedPath)
+		so.bufferedBytes -= origSize
+		bufferBytesGauge.Set(float64(so.bufferedBytes))
+	}
+
+	return
+}
+
+// uploadMultipart streams the buffer file to S3 part-by-part, straight off
+// disk, so a high-volume rollover never has to hold the full payload in
+// memory the way bucket.Put does. Each part is sized to multipartPartSize,
+// a fixed constant independent of MultipartThreshold -- MultipartThreshold
+// only decides whether uploadSegment routes a segment here at all, so
+// raising it to make multipart kick in less often can't inflate this
+// buffer. Any failure aborts the multipart upload so S3 doesn't keep
+// billing for the orphaned parts.
+func (so *S3Output) uploadMultipart(segmentPath, path, contentType string, size int64, or OutputRunner) (err error) {
+	f, err := os.Open(segmentPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var multi *s3.Multi
+	err = so.withRetry(or, "InitMulti", func() error {
+		return so.withAuthRLock(func() error {
+			var ierr error
+			multi, ierr = so.bucket.InitMulti(path, contentType, s3.ACL(so.config.ACL), so.putOptions())
+			return ierr
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	or.LogMessage(fmt.Sprintf("Starting multipart upload of %d bytes to %s.", size, path))
+
+	parts := make([]s3.Part, 0)
+	partBuf := make([]byte, multipartPartSize)
+	partNum := 1
+
+	for {
+		n, rerr := io.ReadFull(f, partBuf)
+		if n > 0 {
+			var part s3.Part
+			partData := partBuf[:n]
+			err = so.withRetry(or, fmt.Sprintf("PutPart %d", partNum), func() error {
+				return so.withAuthRLock(func() error {
+					var perr error
+					part, perr = multi.PutPart(partNum, bytes.NewReader(partData))
+					return perr
+				})
+			})
+			if err != nil {
+				or.LogMessage(fmt.Sprintf("Error uploading part %d, aborting multipart upload: %s", partNum, err))
+				multi.Abort()
+				return
+			}
+			uploadBytesTotal.Add(float64(n))
+			parts = append(parts, part)
+			partNum++
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			or.LogMessage(fmt.Sprintf("Error reading buffer file, aborting multipart upload: %s", err))
+			multi.Abort()
+			return
+		}
+	}
+
+	err = so.withRetry(or, "Complete", func() error {
+		return so.withAuthRLock(func() error {
+			return multi.Complete(parts)
+		})
+	})
+	if err != nil {
+		or.LogMessage(fmt.Sprintf("Error completing multipart upload, aborting: %s", err))
+		multi.Abort()
+		return
 	}
 
 	return